@@ -6,6 +6,10 @@ import (
 	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"encoding/base64"
+	"errors"
+	"fmt"
+
+	sshprovider "github.com/samsung-cnct/cluster-api-provider-ssh/cloud/ssh"
 )
 
 // GetIP returns IP of a machine, note that this also REQUIRED by clusterCreator (clusterdeployer.ProviderDeployer)
@@ -31,7 +35,45 @@ func (a *Actuator) GetKubeConfig(c *clusterv1.Cluster, m *clusterv1.Machine) (st
 		return "", err
 	}
 
-	return a.sshClient.GetKubeConfig(privateKey, machineConfig.SSHConfig)
+	sshClient := sshprovider.NewSSHProviderClient(a.kubeClient, m.Spec.Namespace, privateKey, "", machineConfig.SSHConfig)
+
+	recordCertificateRenewalStatus(m, sshClient)
+
+	kubeconfig, err := sshClient.GetKubeConfig()
+	if err != nil {
+		recordHostKeyMismatch(m, err)
+		return "", err
+	}
+
+	return kubeconfig, nil
+}
+
+// recordCertificateRenewalStatus surfaces sshClient's CertificateStatus on
+// m, the same way recordHostKeyMismatch surfaces a host key failure: without
+// it, an SSH certificate entering its CertRenewalWindow is only visible by
+// inspecting CertificateSecretName directly instead of on the Machine.
+func recordCertificateRenewalStatus(m *clusterv1.Machine, sshClient sshprovider.SSHProviderClientInterface) {
+	status, err := sshClient.CertificateStatus()
+	if err != nil || status == nil || !status.NeedsRenewal {
+		return
+	}
+
+	message := fmt.Sprintf("ssh certificate expires at %s and is due for renewal", status.ValidBefore)
+	m.Status.ErrorMessage = &message
+}
+
+// recordHostKeyMismatch marks m with a descriptive error status when err is
+// a sshprovider.HostKeyMismatchError, so that a host presenting a key other
+// than the one pinned or recorded for it shows up as a failed Machine
+// instead of the reconciler silently retrying the same doomed connection.
+func recordHostKeyMismatch(m *clusterv1.Machine, err error) {
+	var hostKeyErr *sshprovider.HostKeyMismatchError
+	if !errors.As(err, &hostKeyErr) {
+		return
+	}
+
+	message := hostKeyErr.Error()
+	m.Status.ErrorMessage = &message
 }
 
 func (a *Actuator) getPrivateKey(cluster *clusterv1.Cluster, master *clusterv1.Machine) (string, error) {
@@ -0,0 +1,142 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/golang/glog"
+	"github.com/samsung-cnct/cluster-api-provider-ssh/cloud/ssh/providerconfig/v1alpha1"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/kubernetes"
+)
+
+// dialThroughBastions reaches s's target host by dialing each configured
+// bastion in turn and chaining through it: the first bastion is dialed
+// directly, each subsequent hop (including the final target) is dialed as a
+// "tcp" connection over the previous hop's already-authenticated
+// *ssh.Client, mirroring ProxyJump.
+func (s *sshProviderClient) dialThroughBastions(ctx context.Context) (*ssh.Client, error) {
+	var current *ssh.Client
+
+	for i, bastion := range s.sshConfig.Bastions {
+		clientConfig, err := bastionClientConfig(s.kubeClient, s.namespace, bastion)
+		if err != nil {
+			return nil, fmt.Errorf("bastion %d (%s): %v", i, bastion.Host, err)
+		}
+
+		address := fmt.Sprintf("%s:%d", bastion.Host, bastion.Port)
+
+		next, err := dialNextHop(current, address, clientConfig)
+		if err != nil {
+			return nil, fmt.Errorf("bastion %d (%s): %w", i, bastion.Host, err)
+		}
+		current = next
+	}
+
+	// Finally, dial the real target through the last bastion.
+	targetConfig, err := s.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	targetAddress := fmt.Sprintf("%s:%d", s.address, s.port)
+
+	target, err := dialNextHop(current, targetAddress, targetConfig)
+	if err != nil {
+		return nil, fmt.Errorf("dialing target %s through bastion chain: %w", targetAddress, err)
+	}
+
+	if s.sshConfig.AgentForwarding {
+		enableAgentForwarding(target)
+	}
+
+	return target, nil
+}
+
+// dialNextHop dials address and completes an SSH handshake with
+// clientConfig, either directly over TCP (if previous is nil, i.e. this is
+// the first hop) or tunnelled through previous's already-established
+// connection (every subsequent hop). On failure it closes previous, since a
+// failed hop leaves the rest of the chain unreachable.
+func dialNextHop(previous *ssh.Client, address string, clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	var conn ssh.Conn
+	var chans <-chan ssh.NewChannel
+	var reqs <-chan *ssh.Request
+	var err error
+	var tcpConn net.Conn
+
+	if previous == nil {
+		tcpConn, err = dialKeepalive(address)
+		if err != nil {
+			return nil, err
+		}
+		conn, chans, reqs, err = ssh.NewClientConn(tcpConn, address, clientConfig)
+	} else {
+		netConn, dialErr := previous.Dial("tcp", address)
+		if dialErr != nil {
+			closePrevious(previous)
+			return nil, dialErr
+		}
+		conn, chans, reqs, err = ssh.NewClientConn(netConn, address, clientConfig)
+	}
+
+	if err != nil {
+		if previous != nil {
+			closePrevious(previous)
+		} else {
+			tcpConn.Close()
+		}
+		return nil, err
+	}
+
+	return ssh.NewClient(conn, chans, reqs), nil
+}
+
+func closePrevious(client *ssh.Client) {
+	if err := client.Close(); err != nil {
+		glog.Errorf("failed to close bastion connection after hop failure: %v", err)
+	}
+}
+
+// bastionClientConfig authenticates to a single bastion hop using its own
+// credentials and host key trust settings.
+func bastionClientConfig(kubeClient kubernetes.Interface, namespace string, bastion v1alpha1.BastionConfig) (*ssh.ClientConfig, error) {
+	sshAuthMethods := make([]ssh.AuthMethod, 0)
+
+	if bastion.SecretName != "" {
+		privateKey, err := loadPrivateKeySecret(kubeClient, namespace, bastion.SecretName)
+		if err != nil {
+			return nil, err
+		}
+
+		publicKeyMethod, err := PublicKeyFile(privateKey, "")
+		if err != nil {
+			return nil, err
+		}
+		sshAuthMethods = append(sshAuthMethods, publicKeyMethod)
+	}
+
+	sshAgent := SSHAgent()
+	if sshAgent != nil {
+		sshAuthMethods = append(sshAuthMethods, sshAgent)
+	}
+
+	hostKeyCallback, err := newHostKeyCallback(kubeClient, namespace, v1alpha1.SSHConfig{
+		Host:                 bastion.Host,
+		KnownHostsSecretName: bastion.KnownHostsSecretName,
+		TrustOnFirstUse:      bastion.TrustOnFirstUse,
+		HostKeyFingerprint:   bastion.HostKeyFingerprint,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:              bastion.Username,
+		Auth:              sshAuthMethods,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: preferredHostKeyAlgorithms,
+		Timeout:           SshTimeout,
+	}, nil
+}
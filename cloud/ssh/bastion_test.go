@@ -0,0 +1,258 @@
+package ssh
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/samsung-cnct/cluster-api-provider-ssh/cloud/ssh/providerconfig/v1alpha1"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testKeyPair is an in-memory RSA key usable both as an ssh.Signer (for a
+// test server's host key or a client's auth) and, via pem, as the
+// raw PEM text sshProviderClient/PublicKeyFile expect.
+type testKeyPair struct {
+	signer ssh.Signer
+	pem    string
+}
+
+func newTestKeyPair(t *testing.T) testKeyPair {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+
+	pemBytes := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("failed to derive signer from test key: %v", err)
+	}
+
+	return testKeyPair{signer: signer, pem: string(pemBytes)}
+}
+
+// testSSHServer is a minimal in-process SSH server used to exercise bastion
+// chaining without a real remote host. It authenticates a single public key
+// and, if forwarding is enabled, serves "direct-tcpip" channels by dialing
+// the requested address locally - exactly what ProxyJump needs from a
+// bastion hop.
+type testSSHServer struct {
+	addr string
+}
+
+func startTestSSHServer(t *testing.T, hostKey testKeyPair, authorizedClientKey ssh.PublicKey, allowForwarding bool) *testSSHServer {
+	t.Helper()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(authorizedClientKey.Marshal()) {
+				return nil, fmt.Errorf("unknown public key for %q", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey.signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSHConn(netConn, config, allowForwarding)
+		}
+	}()
+
+	return &testSSHServer{addr: listener.Addr().String()}
+}
+
+func serveTestSSHConn(netConn net.Conn, config *ssh.ServerConfig, allowForwarding bool) {
+	defer netConn.Close()
+
+	conn, chans, reqs, err := ssh.NewServerConn(netConn, config)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" || !allowForwarding {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		go forwardDirectTCPIP(newChannel)
+	}
+}
+
+// forwardDirectTCPIP accepts a "direct-tcpip" channel and pipes it to the
+// address it requests, mirroring what an OpenSSH bastion does for ProxyJump.
+func forwardDirectTCPIP(newChannel ssh.NewChannel) {
+	var payload struct {
+		DestAddr   string
+		DestPort   uint32
+		OriginAddr string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "malformed direct-tcpip payload")
+		return
+	}
+
+	target, err := net.Dial("tcp", fmt.Sprintf("%s:%d", payload.DestAddr, payload.DestPort))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	go func() {
+		defer channel.Close()
+		defer target.Close()
+		io.Copy(target, channel)
+	}()
+	go func() {
+		defer channel.Close()
+		defer target.Close()
+		io.Copy(channel, target)
+	}()
+}
+
+func splitHostPort(t *testing.T, addr string) (string, int) {
+	t.Helper()
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("failed to split test server address %q: %v", addr, err)
+	}
+
+	var port int
+	if _, err := fmt.Sscanf(portStr, "%d", &port); err != nil {
+		t.Fatalf("failed to parse test server port %q: %v", portStr, err)
+	}
+
+	return host, port
+}
+
+// TestDialThroughBastions verifies that a single bastion hop is chained
+// correctly: the bastion is dialed directly and the final target is dialed
+// as a "direct-tcpip" channel tunnelled through it, as ProxyJump does.
+func TestDialThroughBastions(t *testing.T) {
+	targetHostKey := newTestKeyPair(t)
+	targetClientKey := newTestKeyPair(t)
+	targetServer := startTestSSHServer(t, targetHostKey, targetClientKey.signer.PublicKey(), false)
+	targetHost, targetPort := splitHostPort(t, targetServer.addr)
+
+	bastionHostKey := newTestKeyPair(t)
+	bastionClientKey := newTestKeyPair(t)
+	bastionServer := startTestSSHServer(t, bastionHostKey, bastionClientKey.signer.PublicKey(), true)
+	bastionHost, bastionPort := splitHostPort(t, bastionServer.addr)
+
+	secretName := "bastion-key"
+	kubeClient := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: meta_v1.ObjectMeta{Name: secretName, Namespace: "default"},
+		Data: map[string][]byte{
+			"private-key": []byte(base64.StdEncoding.EncodeToString([]byte(bastionClientKey.pem))),
+		},
+	})
+
+	sshConfig := v1alpha1.SSHConfig{
+		Username:           "target-user",
+		Host:               targetHost,
+		Port:               targetPort,
+		HostKeyFingerprint: fingerprintSHA256(targetHostKey.signer.PublicKey()),
+		Bastions: []v1alpha1.BastionConfig{
+			{
+				Username:           "bastion-user",
+				Host:               bastionHost,
+				Port:               bastionPort,
+				SecretName:         secretName,
+				HostKeyFingerprint: fingerprintSHA256(bastionHostKey.signer.PublicKey()),
+			},
+		},
+	}
+
+	s := NewSSHProviderClient(kubeClient, "default", targetClientKey.pem, "", sshConfig)
+
+	client, err := s.dialThroughBastions(context.Background())
+	if err != nil {
+		t.Fatalf("dialThroughBastions returned an error: %v", err)
+	}
+	defer client.Close()
+}
+
+// TestDialThroughBastions_HostKeyMismatch verifies that a bastion presenting
+// an unexpected host key fails the hop instead of silently proceeding.
+func TestDialThroughBastions_HostKeyMismatch(t *testing.T) {
+	targetHostKey := newTestKeyPair(t)
+	targetClientKey := newTestKeyPair(t)
+	targetServer := startTestSSHServer(t, targetHostKey, targetClientKey.signer.PublicKey(), false)
+	targetHost, targetPort := splitHostPort(t, targetServer.addr)
+
+	bastionHostKey := newTestKeyPair(t)
+	bastionClientKey := newTestKeyPair(t)
+	bastionServer := startTestSSHServer(t, bastionHostKey, bastionClientKey.signer.PublicKey(), true)
+	bastionHost, bastionPort := splitHostPort(t, bastionServer.addr)
+
+	wrongHostKey := newTestKeyPair(t)
+
+	secretName := "bastion-key"
+	kubeClient := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: meta_v1.ObjectMeta{Name: secretName, Namespace: "default"},
+		Data: map[string][]byte{
+			"private-key": []byte(base64.StdEncoding.EncodeToString([]byte(bastionClientKey.pem))),
+		},
+	})
+
+	sshConfig := v1alpha1.SSHConfig{
+		Username:           "target-user",
+		Host:               targetHost,
+		Port:               targetPort,
+		HostKeyFingerprint: fingerprintSHA256(targetHostKey.signer.PublicKey()),
+		Bastions: []v1alpha1.BastionConfig{
+			{
+				Username:           "bastion-user",
+				Host:               bastionHost,
+				Port:               bastionPort,
+				SecretName:         secretName,
+				HostKeyFingerprint: fingerprintSHA256(wrongHostKey.signer.PublicKey()),
+			},
+		},
+	}
+
+	s := NewSSHProviderClient(kubeClient, "default", targetClientKey.pem, "", sshConfig)
+
+	if _, err := s.dialThroughBastions(context.Background()); err == nil {
+		t.Fatal("expected dialThroughBastions to fail on a bastion host key mismatch, got nil error")
+	}
+}
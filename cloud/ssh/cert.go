@@ -0,0 +1,124 @@
+package ssh
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/kubernetes"
+)
+
+// defaultCertRenewalWindow is used when v1alpha1.SSHConfig.CertRenewalWindow
+// is empty or fails to parse.
+const defaultCertRenewalWindow = 7 * 24 * time.Hour
+
+// CertificateExpiredError is returned when a configured SSH certificate's
+// ValidBefore has already passed; the connection is refused rather than
+// attempted with a credential the remote end is expected to reject anyway.
+type CertificateExpiredError struct {
+	SecretName  string
+	ValidBefore time.Time
+}
+
+func (e *CertificateExpiredError) Error() string {
+	return fmt.Sprintf("ssh certificate in secret %s expired at %s", e.SecretName, e.ValidBefore)
+}
+
+// loadCertSigner loads the private key and signed certificate from
+// secretName's "private-key" and "cert-pub" keys and combines them into a
+// certificate-authenticating ssh.Signer, refusing to proceed if the
+// certificate has expired.
+func loadCertSigner(kubeClient kubernetes.Interface, namespace string, secretName string, passPhrase string) (ssh.Signer, error) {
+	signer, cert, err := loadCertificate(kubeClient, namespace, secretName, passPhrase)
+	if err != nil {
+		return nil, err
+	}
+
+	validBefore := certValidBefore(cert)
+	if !validBefore.IsZero() && time.Now().After(validBefore) {
+		return nil, &CertificateExpiredError{SecretName: secretName, ValidBefore: validBefore}
+	}
+
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// loadCertificate reads and parses the private key and certificate from
+// secretName without checking expiry, so CertificateStatus can report on an
+// already-expired certificate instead of only erroring out.
+func loadCertificate(kubeClient kubernetes.Interface, namespace string, secretName string, passPhrase string) (ssh.Signer, *ssh.Certificate, error) {
+	privateKey, err := loadSecretValue(kubeClient, namespace, secretName, privateKeySecretKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPub, err := loadSecretValue(kubeClient, namespace, secretName, certPubSecretKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var signer ssh.Signer
+	if passPhrase == "" {
+		signer, err = ssh.ParsePrivateKey([]byte(privateKey))
+	} else {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(privateKey), []byte(passPhrase))
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse private key in secret %s/%s: %v", namespace, secretName, err)
+	}
+
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(certPub))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %q from secret %s/%s: %v", certPubSecretKey, namespace, secretName, err)
+	}
+
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return nil, nil, fmt.Errorf("%q in secret %s/%s is not an SSH certificate", certPubSecretKey, namespace, secretName)
+	}
+
+	return signer, cert, nil
+}
+
+// certValidBefore returns cert.ValidBefore as a time.Time, or the zero
+// time if the certificate does not expire.
+func certValidBefore(cert *ssh.Certificate) time.Time {
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return time.Time{}
+	}
+	return time.Unix(int64(cert.ValidBefore), 0)
+}
+
+// CertificateStatus summarizes a machine's configured SSH certificate for
+// callers - in particular the machine controller - that want to surface a
+// condition as it approaches expiry. It returns (nil, nil) when s is not
+// configured to use certificate authentication.
+type CertificateStatus struct {
+	ValidBefore  time.Time
+	NeedsRenewal bool
+}
+
+// CertificateStatus reports whether s's configured certificate (if any) is
+// within its SSHConfig.CertRenewalWindow of expiring.
+func (s *sshProviderClient) CertificateStatus() (*CertificateStatus, error) {
+	if s.sshConfig.CertificateSecretName == "" {
+		return nil, nil
+	}
+
+	_, cert, err := loadCertificate(s.kubeClient, s.namespace, s.sshConfig.CertificateSecretName, s.passPhrase)
+	if err != nil {
+		return nil, err
+	}
+
+	window := defaultCertRenewalWindow
+	if s.sshConfig.CertRenewalWindow != "" {
+		if parsed, err := time.ParseDuration(s.sshConfig.CertRenewalWindow); err == nil {
+			window = parsed
+		}
+	}
+
+	validBefore := certValidBefore(cert)
+	return &CertificateStatus{
+		ValidBefore:  validBefore,
+		NeedsRenewal: !validBefore.IsZero() && time.Until(validBefore) <= window,
+	}, nil
+}
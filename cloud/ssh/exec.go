@@ -0,0 +1,137 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// terminationGrace is how long Run waits for a remote command to exit after
+// sending SIGTERM before escalating to SIGKILL and forcibly closing the
+// session.
+const terminationGrace = 5 * time.Second
+
+// RunOptions configures a single Run call.
+type RunOptions struct {
+	// Timeout bounds how long the remote command may run, separately from
+	// the connection's dial timeout (SshTimeout) and independently of
+	// whether the caller's ctx carries its own deadline. Zero means no
+	// additional timeout is applied.
+	Timeout time.Duration
+
+	// OnStdout and OnStderr, when set, are called with each chunk of
+	// output as it arrives, in addition to it being collected into the
+	// returned RunResult. Useful for streaming progress from long-running
+	// kubeadm operations instead of waiting for completion.
+	OnStdout func(chunk []byte)
+	OnStderr func(chunk []byte)
+}
+
+// RunResult is the outcome of a remote command that exited normally,
+// successfully or not - Run only returns an error for connection, session
+// or cancellation failures.
+type RunResult struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+}
+
+// Run executes cmd on the pooled connection for s, returning its stdout and
+// stderr separately along with its numeric exit status. Unlike ProcessCMD
+// and ProcessCMDWithOutput, a non-zero exit is reported via
+// RunResult.ExitCode rather than as an error. ctx cancellation (including
+// opts.Timeout expiring) sends SIGTERM, then SIGKILL after terminationGrace,
+// and closes the session; Run then returns ctx.Err().
+func (s *sshProviderClient) Run(ctx context.Context, cmd string, opts RunOptions) (*RunResult, error) {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	session, err := sshPool.Acquire(ctx, s.poolKey(), s.dialClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire a pooled session: %w", err)
+	}
+
+	session.Stdout.SetCallback(opts.OnStdout)
+	session.Stderr.SetCallback(opts.OnStderr)
+
+	if s.sshConfig.AgentForwarding {
+		if err := agent.RequestAgentForwarding(session.Session); err != nil {
+			glog.Errorf("failed to request agent forwarding: %v", err)
+		}
+	}
+
+	if err := session.Session.Start(cmd); err != nil {
+		session.Release(true)
+		return nil, err
+	}
+
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- session.Session.Wait() }()
+
+	runErr := waitForCompletionOrCancel(ctx, session.Session, waitErr)
+	session.pipesDone.Wait()
+
+	exitCode, resultErr := exitCodeFromError(runErr)
+	session.Release(isSessionFailure(resultErr))
+
+	return &RunResult{
+		Stdout:   session.Stdout.Bytes(),
+		Stderr:   session.Stderr.Bytes(),
+		ExitCode: exitCode,
+	}, resultErr
+}
+
+// waitForCompletionOrCancel returns the remote command's Wait error, or, if
+// ctx is cancelled first, terminates the command and returns ctx.Err().
+func waitForCompletionOrCancel(ctx context.Context, session *ssh.Session, waitErr <-chan error) error {
+	select {
+	case err := <-waitErr:
+		return err
+	case <-ctx.Done():
+		terminate(session, waitErr)
+		return ctx.Err()
+	}
+}
+
+// terminate asks the remote command to exit via SIGTERM, escalating to
+// SIGKILL and finally closing the session outright if it has not exited
+// within terminationGrace.
+func terminate(session *ssh.Session, waitErr <-chan error) {
+	if err := session.Signal(ssh.SIGTERM); err != nil {
+		glog.Errorf("failed to send SIGTERM to remote command: %v", err)
+	}
+
+	select {
+	case <-waitErr:
+		return
+	case <-time.After(terminationGrace):
+	}
+
+	if err := session.Signal(ssh.SIGKILL); err != nil {
+		glog.Errorf("failed to send SIGKILL to remote command: %v", err)
+	}
+	if err := session.Close(); err != nil {
+		glog.Errorf("failed to close unresponsive remote command's session: %v", err)
+	}
+}
+
+// exitCodeFromError turns the error Session.Wait returned into an exit
+// code, unwrapping *ssh.ExitError. Any other error (a transport failure or
+// the ctx.Err() from waitForCompletionOrCancel) is passed through as-is and
+// the exit code is meaningless.
+func exitCodeFromError(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return exitErr.ExitStatus(), nil
+	}
+	return -1, err
+}
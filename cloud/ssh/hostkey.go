@@ -0,0 +1,167 @@
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	corev1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/samsung-cnct/cluster-api-provider-ssh/cloud/ssh/providerconfig/v1alpha1"
+)
+
+const knownHostsSecretKey = "known_hosts"
+
+// preferredHostKeyAlgorithms is passed as ssh.ClientConfig.HostKeyAlgorithms
+// so that hosts offering a mix of key types are steered towards the ones
+// operators are most likely to have pinned or recorded in known_hosts,
+// instead of whatever x/crypto/ssh would otherwise negotiate first.
+var preferredHostKeyAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoRSASHA512,
+	ssh.KeyAlgoRSASHA256,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+}
+
+// HostKeyMismatchError is returned by the ssh.HostKeyCallback built by
+// newHostKeyCallback when the key presented by a host does not match the
+// key pinned or previously recorded for it. It reaches callers wrapped, so
+// the machine controller detects it with errors.As to mark the Machine with
+// a condition instead of silently retrying the connection.
+type HostKeyMismatchError struct {
+	Host     string
+	Expected string
+	Got      string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("ssh: host key mismatch for %s: expected %s, got %s", e.Host, e.Expected, e.Got)
+}
+
+func fingerprintSHA256(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// newHostKeyCallback builds the ssh.HostKeyCallback used by clientConfig and
+// bastionClientConfig for every target and bastion dial.
+// machineSSHConfig selects the verification mode:
+//
+//   - HostKeyFingerprint set: the presented key must match that SHA256
+//     fingerprint exactly.
+//   - KnownHostsSecretName set: the key is checked against the
+//     "known_hosts" entry of that Secret. If TrustOnFirstUse is set and no
+//     entry exists yet for the host, the presented key is accepted and
+//     appended to the Secret.
+//   - neither set: refuse to connect. Refusing is deliberately the default
+//     so that omitting SSHConfig trust settings cannot silently reintroduce
+//     the MITM exposure this replaces.
+func newHostKeyCallback(kubeClient kubernetes.Interface, namespace string, machineSSHConfig v1alpha1.SSHConfig) (ssh.HostKeyCallback, error) {
+	if machineSSHConfig.HostKeyFingerprint != "" {
+		expected := machineSSHConfig.HostKeyFingerprint
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if got := fingerprintSHA256(key); got != expected {
+				return &HostKeyMismatchError{Host: hostname, Expected: expected, Got: got}
+			}
+			return nil
+		}, nil
+	}
+
+	if machineSSHConfig.KnownHostsSecretName == "" {
+		return nil, fmt.Errorf("sshConfig for %s must set hostKeyFingerprint or knownHostsSecretName", machineSSHConfig.Host)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return verifyOrTrustKnownHosts(kubeClient, namespace, machineSSHConfig, hostname, remote, key)
+	}, nil
+}
+
+// verifyOrTrustKnownHosts checks key against the known_hosts data stored in
+// machineSSHConfig.KnownHostsSecretName, appending a TOFU entry when allowed.
+func verifyOrTrustKnownHosts(kubeClient kubernetes.Interface, namespace string, machineSSHConfig v1alpha1.SSHConfig, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	secret, err := kubeClient.CoreV1().Secrets(namespace).Get(machineSSHConfig.KnownHostsSecretName, meta_v1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to load known_hosts secret %s/%s: %v", namespace, machineSSHConfig.KnownHostsSecretName, err)
+	}
+
+	callback, err := knownHostsCallback(secret.Data[knownHostsSecretKey])
+	if err != nil {
+		return fmt.Errorf("failed to parse known_hosts secret %s/%s: %v", namespace, machineSSHConfig.KnownHostsSecretName, err)
+	}
+
+	err = callback(hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	if !knownhostsIsKeyError(err, &keyErr) || len(keyErr.Want) != 0 {
+		// Either an unexpected parse error, or the host IS known and
+		// presented a different key: a real MITM candidate, not a
+		// first-use gap.
+		return &HostKeyMismatchError{Host: hostname, Expected: "recorded known_hosts entry", Got: fingerprintSHA256(key)}
+	}
+
+	if !machineSSHConfig.TrustOnFirstUse {
+		return &HostKeyMismatchError{Host: hostname, Expected: "an entry in " + machineSSHConfig.KnownHostsSecretName, Got: "no entry (trustOnFirstUse is disabled)"}
+	}
+
+	return trustHostKey(kubeClient, namespace, secret, hostname, key)
+}
+
+// knownhostsIsKeyError unwraps knownhosts.New's callback error into a
+// *knownhosts.KeyError, distinguishing "host unknown" (Want is empty) from
+// "host known, key changed" (Want is non-empty).
+func knownhostsIsKeyError(err error, target **knownhosts.KeyError) bool {
+	keyErr, ok := err.(*knownhosts.KeyError)
+	if !ok {
+		return false
+	}
+	*target = keyErr
+	return true
+}
+
+// knownHostsCallback parses known_hosts formatted data via a temp file,
+// since knownhosts.New only reads from paths on disk.
+func knownHostsCallback(data []byte) (ssh.HostKeyCallback, error) {
+	tempFile, err := ioutil.TempFile(os.TempDir(), "known_hosts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	if _, err := tempFile.Write(data); err != nil {
+		return nil, err
+	}
+	if err := tempFile.Close(); err != nil {
+		return nil, err
+	}
+
+	return knownhosts.New(tempFile.Name())
+}
+
+// trustHostKey appends a known_hosts line for hostname/key to secret and
+// persists it, implementing the trust-on-first-use write path.
+func trustHostKey(kubeClient kubernetes.Interface, namespace string, secret *corev1.Secret, hostname string, key ssh.PublicKey) error {
+	line := knownhosts.Line([]string{hostname}, key) + "\n"
+
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[knownHostsSecretKey] = append(secret.Data[knownHostsSecretKey], []byte(line)...)
+
+	if _, err := kubeClient.CoreV1().Secrets(namespace).Update(secret); err != nil {
+		return fmt.Errorf("failed to persist trust-on-first-use host key for %s: %v", hostname, err)
+	}
+	return nil
+}
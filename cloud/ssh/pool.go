@@ -0,0 +1,423 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultMaxSessionsPerConnection = 8
+	defaultIdleConnectionTTL        = 10 * time.Minute
+	defaultReapInterval             = time.Minute
+)
+
+var (
+	poolHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cluster_api_provider_ssh_pool_hits_total",
+		Help: "SSHConnectionPool.Acquire calls served by an existing connection.",
+	})
+	poolMissesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cluster_api_provider_ssh_pool_misses_total",
+		Help: "SSHConnectionPool.Acquire calls that dialed a new connection.",
+	})
+	poolEvictionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cluster_api_provider_ssh_pool_evictions_total",
+		Help: "Pooled connections closed after a session-level failure, idle TTL expiry or pool Close.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(poolHitsTotal, poolMissesTotal, poolEvictionsTotal)
+}
+
+// poolKey identifies an SSH endpoint+identity that sessions can safely be
+// multiplexed across: two sshProviderClients with the same key are
+// indistinguishable from the remote end's point of view.
+type poolKey struct {
+	user           string
+	host           string
+	port           int
+	keyFingerprint string
+}
+
+func (k poolKey) String() string {
+	return fmt.Sprintf("%s@%s:%d[%s]", k.user, k.host, k.port, k.keyFingerprint)
+}
+
+// dialFunc dials and authenticates a fresh *ssh.Client for key. Callers
+// supply it on each Acquire rather than the pool storing one, since the
+// credentials and host key trust settings live on the caller
+// (sshProviderClient), not on the shared pool.
+type dialFunc func(ctx context.Context) (*ssh.Client, error)
+
+type pooledConn struct {
+	client *ssh.Client
+	sem    chan struct{} // caps concurrent sessions per connection
+
+	mu       sync.Mutex
+	sessions int
+	lastUsed time.Time
+	closed   bool
+}
+
+func (c *pooledConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// SSHConnectionPool keeps one live *ssh.Client per poolKey and multiplexes
+// ssh.Sessions over it instead of dialing and tearing a connection down for
+// every command. A connection is evicted as soon as a session on it fails,
+// and idle connections are closed by a background reaper after maxIdle.
+type SSHConnectionPool struct {
+	maxSessionsPerConn int
+	maxIdle            time.Duration
+
+	mu    sync.Mutex
+	conns map[poolKey]*pooledConn
+
+	// dialMu serializes connFor's dial for a given key, so two callers
+	// racing on the same not-yet-cached key don't each dial their own
+	// *ssh.Client - see dialLockFor.
+	dialMu sync.Map // poolKey -> *sync.Mutex
+
+	stopReaper chan struct{}
+}
+
+// PoolOption configures an SSHConnectionPool at construction time.
+type PoolOption func(*SSHConnectionPool)
+
+// WithMaxSessionsPerConnection caps how many ssh.Sessions may be open
+// concurrently on a single pooled connection, working around known
+// x/crypto/ssh concurrency issues under heavy multiplexing.
+func WithMaxSessionsPerConnection(n int) PoolOption {
+	return func(p *SSHConnectionPool) { p.maxSessionsPerConn = n }
+}
+
+// WithIdleConnectionTTL overrides how long a connection with no open
+// sessions is kept before the reaper closes it.
+func WithIdleConnectionTTL(d time.Duration) PoolOption {
+	return func(p *SSHConnectionPool) { p.maxIdle = d }
+}
+
+// NewSSHConnectionPool creates an empty pool and starts its background
+// reaper. Callers must call Close when done with the pool.
+func NewSSHConnectionPool(opts ...PoolOption) *SSHConnectionPool {
+	p := &SSHConnectionPool{
+		maxSessionsPerConn: defaultMaxSessionsPerConnection,
+		maxIdle:            defaultIdleConnectionTTL,
+		conns:              make(map[poolKey]*pooledConn),
+		stopReaper:         make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	go p.reapLoop()
+
+	return p
+}
+
+// teeBuffer collects everything written to it, like bytes.Buffer, but also
+// hands each chunk to an optional callback as it arrives - the mechanism
+// Run's streaming RunOptions callbacks are built on.
+type teeBuffer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	onChunk func([]byte)
+}
+
+func (t *teeBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	n, err := t.buf.Write(p)
+	cb := t.onChunk
+	t.mu.Unlock()
+
+	if cb != nil {
+		cb(p[:n])
+	}
+	return n, err
+}
+
+func (t *teeBuffer) Bytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte(nil), t.buf.Bytes()...)
+}
+
+// SetCallback installs cb to be called with each chunk written from this
+// point on. It must be called before the remote command starts producing
+// output (i.e. before Session.Start) to avoid missing early chunks.
+func (t *teeBuffer) SetCallback(cb func([]byte)) {
+	t.mu.Lock()
+	t.onChunk = cb
+	t.mu.Unlock()
+}
+
+// PooledSession wraps an *ssh.Session whose stdout/stderr are already being
+// drained into Stdout/Stderr, avoiding the documented x/crypto/ssh deadlock
+// where an unserviced pipe blocks Session.Wait indefinitely.
+type PooledSession struct {
+	*ssh.Session
+
+	Stdout *teeBuffer
+	Stderr *teeBuffer
+
+	pool      *SSHConnectionPool
+	key       poolKey
+	conn      *pooledConn
+	pipesDone sync.WaitGroup
+}
+
+// Release returns the session's slot on its connection. failed should be
+// true whenever the caller observed a session- or transport-level error (as
+// opposed to the remote command merely exiting non-zero): a failed session
+// evicts the whole connection so the next Acquire redials instead of
+// reusing a connection that may be wedged.
+func (ps *PooledSession) Release(failed bool) {
+	ps.Session.Close()
+	<-ps.conn.sem
+
+	ps.conn.mu.Lock()
+	ps.conn.sessions--
+	ps.conn.lastUsed = time.Now()
+	ps.conn.mu.Unlock()
+
+	if failed {
+		ps.pool.evict(ps.key, ps.conn)
+	}
+}
+
+// Acquire returns a pooled, ready-to-use session for key, reusing an
+// existing connection when one is live or dialing a new one via dial. It
+// blocks until a session slot is free on the chosen connection or ctx is
+// done. Callers must call Release on the returned session exactly once.
+func (p *SSHConnectionPool) Acquire(ctx context.Context, key poolKey, dial dialFunc) (*PooledSession, error) {
+	conn, err := p.connFor(ctx, key, dial)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case conn.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	session, err := conn.client.NewSession()
+	if err != nil {
+		<-conn.sem
+		p.evict(key, conn)
+		return nil, fmt.Errorf("failed to open session on pooled connection to %s: %v", key, err)
+	}
+
+	stdoutPipe, err := session.StdoutPipe()
+	if err != nil {
+		<-conn.sem
+		session.Close()
+		p.evict(key, conn)
+		return nil, err
+	}
+	stderrPipe, err := session.StderrPipe()
+	if err != nil {
+		<-conn.sem
+		session.Close()
+		p.evict(key, conn)
+		return nil, err
+	}
+
+	ps := &PooledSession{
+		Session: session,
+		Stdout:  &teeBuffer{},
+		Stderr:  &teeBuffer{},
+		pool:    p,
+		key:     key,
+		conn:    conn,
+	}
+
+	ps.pipesDone.Add(2)
+	go func() { defer ps.pipesDone.Done(); io.Copy(ps.Stdout, stdoutPipe) }()
+	go func() { defer ps.pipesDone.Done(); io.Copy(ps.Stderr, stderrPipe) }()
+
+	conn.mu.Lock()
+	conn.sessions++
+	conn.lastUsed = time.Now()
+	conn.mu.Unlock()
+
+	return ps, nil
+}
+
+// AcquireClient returns the underlying *ssh.Client for key for callers that
+// need to manage their own channels instead of a plain exec session - e.g.
+// SFTPClient, which opens its own subsystem channel. The returned release
+// must be called exactly once, with failed set as PooledSession.Release's.
+func (p *SSHConnectionPool) AcquireClient(ctx context.Context, key poolKey, dial dialFunc) (*ssh.Client, func(failed bool), error) {
+	conn, err := p.connFor(ctx, key, dial)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	select {
+	case conn.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+
+	conn.mu.Lock()
+	conn.sessions++
+	conn.lastUsed = time.Now()
+	conn.mu.Unlock()
+
+	release := func(failed bool) {
+		<-conn.sem
+
+		conn.mu.Lock()
+		conn.sessions--
+		conn.lastUsed = time.Now()
+		conn.mu.Unlock()
+
+		if failed {
+			p.evict(key, conn)
+		}
+	}
+
+	return conn.client, release, nil
+}
+
+// dialLockFor returns the mutex serializing connFor's dial for key, creating
+// it on first use. It is never removed: the set of distinct keys a pool
+// sees in practice is bounded by its distinct SSH targets, same as p.conns.
+func (p *SSHConnectionPool) dialLockFor(key poolKey) *sync.Mutex {
+	lock, _ := p.dialMu.LoadOrStore(key, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// connFor returns the live connection for key, dialing a new one with dial
+// if none exists yet or the existing one has been evicted. Concurrent
+// callers for the same key serialize on dialLockFor rather than each
+// dialing their own *ssh.Client: without it, the loser of the race would
+// never be stored in p.conns (the winner's write replaces it) and so could
+// never be reaped or evicted, leaking its socket and keepalive goroutine.
+func (p *SSHConnectionPool) connFor(ctx context.Context, key poolKey, dial dialFunc) (*pooledConn, error) {
+	p.mu.Lock()
+	conn, ok := p.conns[key]
+	p.mu.Unlock()
+
+	if ok && !conn.isClosed() {
+		poolHitsTotal.Inc()
+		return conn, nil
+	}
+
+	dialLock := p.dialLockFor(key)
+	dialLock.Lock()
+	defer dialLock.Unlock()
+
+	// Re-check now that we hold the dial lock: another goroutine may have
+	// already dialed and published the connection for key while we were
+	// waiting for it.
+	p.mu.Lock()
+	conn, ok = p.conns[key]
+	p.mu.Unlock()
+
+	if ok && !conn.isClosed() {
+		poolHitsTotal.Inc()
+		return conn, nil
+	}
+
+	poolMissesTotal.Inc()
+	client, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn = &pooledConn{
+		client:   client,
+		sem:      make(chan struct{}, p.maxSessionsPerConn),
+		lastUsed: time.Now(),
+	}
+
+	p.mu.Lock()
+	p.conns[key] = conn
+	p.mu.Unlock()
+
+	return conn, nil
+}
+
+// evict closes conn and removes it from the pool, provided it is still the
+// connection registered for key (it may already have been replaced).
+func (p *SSHConnectionPool) evict(key poolKey, conn *pooledConn) {
+	p.mu.Lock()
+	if current, ok := p.conns[key]; ok && current == conn {
+		delete(p.conns, key)
+	}
+	p.mu.Unlock()
+
+	conn.mu.Lock()
+	alreadyClosed := conn.closed
+	conn.closed = true
+	conn.mu.Unlock()
+
+	if !alreadyClosed {
+		conn.client.Close()
+		poolEvictionsTotal.Inc()
+	}
+}
+
+func (p *SSHConnectionPool) reapLoop() {
+	t := time.NewTicker(defaultReapInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			p.reapIdle()
+		case <-p.stopReaper:
+			return
+		}
+	}
+}
+
+func (p *SSHConnectionPool) reapIdle() {
+	type expired struct {
+		key  poolKey
+		conn *pooledConn
+	}
+
+	p.mu.Lock()
+	var idle []expired
+	for key, conn := range p.conns {
+		conn.mu.Lock()
+		if conn.sessions == 0 && time.Since(conn.lastUsed) > p.maxIdle {
+			idle = append(idle, expired{key, conn})
+		}
+		conn.mu.Unlock()
+	}
+	p.mu.Unlock()
+
+	for _, e := range idle {
+		p.evict(e.key, e.conn)
+	}
+}
+
+// Close stops the reaper and closes every connection currently pooled.
+func (p *SSHConnectionPool) Close() {
+	close(p.stopReaper)
+
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = make(map[poolKey]*pooledConn)
+	p.mu.Unlock()
+
+	for key, conn := range conns {
+		p.evict(key, conn)
+	}
+}
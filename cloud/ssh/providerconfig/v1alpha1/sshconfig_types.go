@@ -0,0 +1,73 @@
+package v1alpha1
+
+// SSHConfig declares how the actuator reaches a single Machine over SSH and
+// how it is expected to verify that it is talking to the right host.
+type SSHConfig struct {
+	Username string `json:"username"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+
+	// SecretName names the Secret holding the private key used to
+	// authenticate to Host.
+	SecretName string `json:"secretName"`
+
+	// KnownHostsSecretName, when set, names a Secret in the same namespace
+	// as the Machine whose "known_hosts" key is used to verify the host key
+	// presented by Host. With TrustOnFirstUse set, a first-seen key for
+	// Host is appended to this Secret instead of being rejected.
+	KnownHostsSecretName string `json:"knownHostsSecretName,omitempty"`
+
+	// TrustOnFirstUse enables trust-on-first-use verification: if Host has
+	// no entry in KnownHostsSecretName yet, the presented host key is
+	// accepted and persisted rather than rejected.
+	TrustOnFirstUse bool `json:"trustOnFirstUse,omitempty"`
+
+	// HostKeyFingerprint pins the expected host key by its SHA256
+	// fingerprint, in the same "SHA256:base64..." form `ssh-keygen -lf`
+	// prints. When set it takes precedence over KnownHostsSecretName.
+	HostKeyFingerprint string `json:"hostKeyFingerprint,omitempty"`
+
+	// CertificateSecretName, when set, names a Secret containing both a
+	// "private-key" and a signed "cert-pub" (an OpenSSH user certificate,
+	// as produced by `ssh-keygen -s`). The two are combined via
+	// ssh.NewCertSigner and used instead of SecretName's raw private key.
+	CertificateSecretName string `json:"certificateSecretName,omitempty"`
+
+	// CertRenewalWindow, parsed with time.ParseDuration (e.g. "168h"), is
+	// how long before the certificate's ValidBefore it is considered due
+	// for renewal. Defaults to 7 days if empty or unparsable.
+	CertRenewalWindow string `json:"certRenewalWindow,omitempty"`
+
+	// AgentForwarding requests ssh-agent forwarding on sessions opened
+	// against Host, so kubeadm-driven scp/ssh sub-invocations on the
+	// remote host can reuse the operator's local agent.
+	AgentForwarding bool `json:"agentForwarding,omitempty"`
+
+	// Bastions, when non-empty, are dialed in order and chained via
+	// ProxyJump-style TCP forwarding to reach Host: Bastions[0] is dialed
+	// directly, Bastions[1] is dialed through Bastions[0], and so on, with
+	// Host itself finally dialed through the last bastion. This lets
+	// on-prem clusters whose worker nodes are not publicly routable be
+	// reached through one or more jump hosts.
+	Bastions []BastionConfig `json:"bastions,omitempty"`
+}
+
+// BastionConfig is a single jump host in an SSHConfig.Bastions chain. It
+// carries its own credentials and host key trust settings, independent of
+// the target SSHConfig's.
+type BastionConfig struct {
+	Username string `json:"username"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+
+	// SecretName names the Secret holding the private key used to
+	// authenticate to this bastion.
+	SecretName string `json:"secretName"`
+
+	// KnownHostsSecretName, TrustOnFirstUse and HostKeyFingerprint verify
+	// this bastion's host key; they behave exactly as the fields of the
+	// same name on SSHConfig.
+	KnownHostsSecretName string `json:"knownHostsSecretName,omitempty"`
+	TrustOnFirstUse      bool   `json:"trustOnFirstUse,omitempty"`
+	HostKeyFingerprint   string `json:"hostKeyFingerprint,omitempty"`
+}
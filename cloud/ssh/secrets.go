@@ -0,0 +1,37 @@
+package ssh
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	privateKeySecretKey = "private-key"
+	certPubSecretKey    = "cert-pub"
+)
+
+// loadPrivateKeySecret reads and base64-decodes the private key stored
+// under privateKeySecretKey in the named Secret, mirroring how the machine
+// actuator resolves a Machine's own private key.
+func loadPrivateKeySecret(kubeClient kubernetes.Interface, namespace string, secretName string) (string, error) {
+	return loadSecretValue(kubeClient, namespace, secretName, privateKeySecretKey)
+}
+
+// loadSecretValue reads and base64-decodes secret.Data[key] from the named
+// Secret.
+func loadSecretValue(kubeClient kubernetes.Interface, namespace string, secretName string, key string) (string, error) {
+	secret, err := kubeClient.CoreV1().Secrets(namespace).Get(secretName, meta_v1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to load secret %s/%s: %v", namespace, secretName, err)
+	}
+
+	valueBytes, err := base64.StdEncoding.DecodeString(string(secret.Data[key]))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %q from secret %s/%s: %v", key, namespace, secretName, err)
+	}
+
+	return string(valueBytes), nil
+}
@@ -0,0 +1,130 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// SFTPClient performs file operations against a single sshProviderClient's
+// target host over SFTP, reusing the same pooled SSH connections as
+// ProcessCMD/Run rather than shelling out to scp/cat.
+type SFTPClient struct {
+	providerClient *sshProviderClient
+}
+
+// NewSFTPClient returns an SFTPClient that operates over s's pooled SSH
+// connection.
+func NewSFTPClient(s *sshProviderClient) *SFTPClient {
+	return &SFTPClient{providerClient: s}
+}
+
+// withClient acquires a pooled *ssh.Client, opens an SFTP subsystem session
+// on it, runs fn, and releases the connection - evicting it if fn or the
+// SFTP handshake failed, since either indicates the connection is suspect.
+func (c *SFTPClient) withClient(ctx context.Context, fn func(*sftp.Client) error) error {
+	client, release, err := sshPool.AcquireClient(ctx, c.providerClient.poolKey(), c.providerClient.dialClient)
+	if err != nil {
+		return fmt.Errorf("failed to acquire a pooled connection: %w", err)
+	}
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		release(true)
+		return fmt.Errorf("failed to start sftp subsystem: %v", err)
+	}
+	defer sftpClient.Close()
+
+	fnErr := fn(sftpClient)
+	release(fnErr != nil)
+	return fnErr
+}
+
+// WriteFileAtomic writes data to path with the given mode. data is written
+// to a sibling temp file and moved into place with PosixRename, so readers
+// never observe a partially written file and an existing file at path is
+// replaced outright rather than rejected.
+func (c *SFTPClient) WriteFileAtomic(ctx context.Context, remotePath string, data []byte, mode os.FileMode) error {
+	return c.withClient(ctx, func(sftpClient *sftp.Client) error {
+		if err := sftpClient.MkdirAll(path.Dir(remotePath)); err != nil {
+			return fmt.Errorf("failed to create parent directory for %s: %v", remotePath, err)
+		}
+
+		tempPath := fmt.Sprintf("%s.tmp.%d.%d", remotePath, os.Getpid(), time.Now().UnixNano())
+
+		f, err := sftpClient.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return fmt.Errorf("failed to create temp file %s: %v", tempPath, err)
+		}
+
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			sftpClient.Remove(tempPath)
+			return fmt.Errorf("failed to write temp file %s: %v", tempPath, err)
+		}
+
+		if err := f.Close(); err != nil {
+			sftpClient.Remove(tempPath)
+			return fmt.Errorf("failed to close temp file %s: %v", tempPath, err)
+		}
+
+		if err := sftpClient.Chmod(tempPath, mode); err != nil {
+			sftpClient.Remove(tempPath)
+			return fmt.Errorf("failed to set mode on temp file %s: %v", tempPath, err)
+		}
+
+		if err := sftpClient.PosixRename(tempPath, remotePath); err != nil {
+			sftpClient.Remove(tempPath)
+			return fmt.Errorf("failed to atomically replace %s: %v", remotePath, err)
+		}
+
+		return nil
+	})
+}
+
+// MkdirAll creates remotePath and any missing parents on the remote host.
+func (c *SFTPClient) MkdirAll(ctx context.Context, remotePath string) error {
+	return c.withClient(ctx, func(sftpClient *sftp.Client) error {
+		return sftpClient.MkdirAll(remotePath)
+	})
+}
+
+// ReadFile returns the contents of remotePath. Unlike exec'ing `cat`, this
+// is binary-safe and surfaces permission/not-found errors distinctly.
+func (c *SFTPClient) ReadFile(ctx context.Context, remotePath string) ([]byte, error) {
+	var data []byte
+	err := c.withClient(ctx, func(sftpClient *sftp.Client) error {
+		f, err := sftpClient.Open(remotePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		data, err = ioutil.ReadAll(f)
+		return err
+	})
+	return data, err
+}
+
+// Stat returns remotePath's remote file info.
+func (c *SFTPClient) Stat(ctx context.Context, remotePath string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := c.withClient(ctx, func(sftpClient *sftp.Client) error {
+		var statErr error
+		info, statErr = sftpClient.Stat(remotePath)
+		return statErr
+	})
+	return info, err
+}
+
+// Remove deletes remotePath on the remote host.
+func (c *SFTPClient) Remove(ctx context.Context, remotePath string) error {
+	return c.withClient(ctx, func(sftpClient *sftp.Client) error {
+		return sftpClient.Remove(remotePath)
+	})
+}
@@ -1,35 +1,47 @@
 package ssh
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"os"
 
 	"github.com/golang/glog"
 	"github.com/samsung-cnct/cluster-api-provider-ssh/cloud/ssh/providerconfig/v1alpha1"
-	"github.com/tmc/scp"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+	"k8s.io/client-go/kubernetes"
 	"time"
 )
 
 const (
-	// TODO: This is to quickly work around a customer problem. We should
-	// implement a connection pool instead.
-	SshTimeoutSeconds    = 600
-	SshTimeout           = time.Duration(SshTimeoutSeconds) * time.Second
-	TCPKeepAlivePeriod   = time.Duration(60) * time.Second
+	SshTimeoutSeconds  = 600
+	SshTimeout         = time.Duration(SshTimeoutSeconds) * time.Second
+	TCPKeepAlivePeriod = time.Duration(60) * time.Second
+
+	// GetKubeconfigCommand is kept for callers still shelling out instead
+	// of using GetKubeConfig/GetKubeConfigBytes, which read kubeconfigPath
+	// directly over SFTP.
 	GetKubeconfigCommand = "cat /etc/kubernetes/admin.conf"
+	kubeconfigPath       = "/etc/kubernetes/admin.conf"
 )
 
+// sshPool is shared by every sshProviderClient in the process: the actuator
+// constructs a fresh sshProviderClient per call, but the underlying
+// *ssh.Client connections it dials are worth reusing across those calls.
+var sshPool = NewSSHConnectionPool()
+
 type SSHProviderClientInterface interface {
+	// ProcessCMD and ProcessCMDWithOutput are kept for existing callers;
+	// Run is the structured replacement and should be preferred by new code.
 	ProcessCMD(cmd string) error
 	ProcessCMDWithOutput(cmd string) ([]byte, error)
+	Run(ctx context.Context, cmd string, opts RunOptions) (*RunResult, error)
 	WritePublicKeys(machineSSHConfig v1alpha1.SSHConfig) error
 	DeletePublicKeys(machineSSHConfig v1alpha1.SSHConfig) error
 	GetKubeConfig() (string, error)
 	GetKubeConfigBytes() ([]byte, error)
+	CertificateStatus() (*CertificateStatus, error)
 }
 
 type sshProviderClient struct {
@@ -38,15 +50,24 @@ type sshProviderClient struct {
 	port       int
 	privateKey string
 	passPhrase string
+
+	// kubeClient and namespace back the host key trust store: known_hosts
+	// and TOFU updates are read from and written to a Secret in namespace.
+	kubeClient kubernetes.Interface
+	namespace  string
+	sshConfig  v1alpha1.SSHConfig
 }
 
-func NewSSHProviderClient(privateKey string, passPhrase string, machineSSHConfig v1alpha1.SSHConfig) *sshProviderClient {
+func NewSSHProviderClient(kubeClient kubernetes.Interface, namespace string, privateKey string, passPhrase string, machineSSHConfig v1alpha1.SSHConfig) *sshProviderClient {
 	return &sshProviderClient{
 		username:   machineSSHConfig.Username,
 		address:    machineSSHConfig.Host,
 		port:       machineSSHConfig.Port,
 		privateKey: privateKey,
 		passPhrase: passPhrase,
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		sshConfig:  machineSSHConfig,
 	}
 }
 
@@ -59,7 +80,7 @@ func (s *sshProviderClient) DeletePublicKeys(machineSSHConfig v1alpha1.SSHConfig
 }
 
 func (s *sshProviderClient) GetKubeConfig() (string, error) {
-	bytes, err := s.ProcessCMDWithOutput(GetKubeconfigCommand)
+	bytes, err := s.GetKubeConfigBytes()
 	if err != nil {
 		return "", err
 	}
@@ -68,104 +89,171 @@ func (s *sshProviderClient) GetKubeConfig() (string, error) {
 }
 
 func (s *sshProviderClient) GetKubeConfigBytes() ([]byte, error) {
-	bytes, err := s.ProcessCMDWithOutput(GetKubeconfigCommand)
-	if err != nil {
-		return nil, err
-	}
-
-	return bytes, nil
+	return NewSFTPClient(s).ReadFile(context.Background(), kubeconfigPath)
 }
 
+// ProcessCMD is a thin wrapper around Run kept for existing callers; new
+// code should call Run directly.
 func (s *sshProviderClient) ProcessCMD(cmd string) error {
-	session, connection, err := GetBasicSession(s)
+	result, err := s.Run(context.Background(), cmd, RunOptions{})
 	if err != nil {
-		return fmt.Errorf("failed to create a session: %v", err)
+		return err
 	}
-	defer session.Close()
-	defer connection.Close()
 
-	outputBytes, err := session.CombinedOutput(cmd)
-	glog.Infof("Command output = %s ", string(outputBytes[:]))
+	glog.Infof("Command output = %s ", string(append(result.Stdout, result.Stderr...)))
 
-	if err != nil {
-		return err
+	if result.ExitCode != 0 {
+		return fmt.Errorf("%s exited %d", cmd, result.ExitCode)
 	}
 	return nil
 }
 
+// ProcessCMDWithOutput is a thin wrapper around Run kept for existing
+// callers; new code should call Run directly.
 func (s *sshProviderClient) ProcessCMDWithOutput(cmd string) ([]byte, error) {
-	session, connection, err := GetBasicSession(s)
+	result, err := s.Run(context.Background(), cmd, RunOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create session: %v", err)
+		return nil, err
+	}
+	if result.ExitCode != 0 {
+		return result.Stdout, fmt.Errorf("%s exited %d", cmd, result.ExitCode)
 	}
-	defer session.Close()
-	defer connection.Close()
 
-	outputBytes, err := session.Output(cmd)
+	return result.Stdout, nil
+}
 
-	return outputBytes, err
+// isSessionFailure reports whether err indicates the session or connection
+// itself misbehaved (a transport failure or Run's ctx being cancelled), so
+// the pool only evicts connections that are actually suspect.
+func isSessionFailure(err error) bool {
+	return err != nil
 }
 
+// bootstrapScriptMode is used for node-bootstrap scripts written via
+// WriteFile, which are expected to be executed on the remote host.
+const bootstrapScriptMode = 0755
+
+// WriteFile atomically writes scriptLines to remotePath as an executable
+// script, over SFTP rather than a temp-file-plus-scp round trip.
 func (s *sshProviderClient) WriteFile(scriptLines string, remotePath string) error {
-	session, connection, err := GetBasicSession(s)
-	if err != nil {
-		return fmt.Errorf("failed to create a session: %v", err)
+	return NewSFTPClient(s).WriteFileAtomic(context.Background(), remotePath, []byte(scriptLines), bootstrapScriptMode)
+}
+
+// poolKey identifies the connection this client's commands can be
+// multiplexed over: same user, host, port and authentication key means the
+// same authenticated *ssh.Client can be shared.
+func (s *sshProviderClient) poolKey() poolKey {
+	return poolKey{
+		user:           s.username,
+		host:           s.address,
+		port:           s.port,
+		keyFingerprint: s.authKeyFingerprint(),
 	}
+}
 
-	defer session.Close()
-	defer connection.Close()
+// authKeyFingerprint identifies the credential s authenticates with.
+// Certificate auth (clientConfig loads the signer from
+// sshConfig.CertificateSecretName rather than s.privateKey) is keyed by the
+// secret name itself, since fingerprinting the actual signer here would mean
+// poolKey - called on every Run/WriteFile - reading the Secret from the
+// Kubernetes API just to build a cache key. Without this, every
+// certificate-authenticated client for a given (user, host, port) is keyed
+// by s.privateKey's fingerprint (or "" when none is set), which clientConfig
+// does not authenticate with, and can be handed a pooled connection
+// authenticated under a different certificate identity.
+func (s *sshProviderClient) authKeyFingerprint() string {
+	if s.sshConfig.CertificateSecretName != "" {
+		return "cert:" + s.sshConfig.CertificateSecretName
+	}
+	return clientKeyFingerprint(s.privateKey, s.passPhrase)
+}
 
-	// create temporary file
-	tempFile, err := ioutil.TempFile(os.TempDir(), "*")
+// clientKeyFingerprint returns the SHA256 fingerprint of the public half of
+// privateKey, or "" when no private key is configured (agent-only auth).
+func clientKeyFingerprint(privateKey string, passPhrase string) string {
+	if privateKey == "" {
+		return ""
+	}
+
+	var signer ssh.Signer
+	var err error
+	if passPhrase == "" {
+		signer, err = ssh.ParsePrivateKey([]byte(privateKey))
+	} else {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(privateKey), []byte(passPhrase))
+	}
 	if err != nil {
-		return err
+		return ""
 	}
-	defer os.Remove(tempFile.Name())
 
-	// copy script lines into file
-	if _, err = tempFile.Write([]byte(scriptLines)); err != nil {
-		return err
+	return fingerprintSHA256(signer.PublicKey())
+}
+
+// dialClient dials and authenticates a new *ssh.Client for s, routing
+// through s.sshConfig.Bastions when set. It is the dialFunc passed to
+// SSHConnectionPool.Acquire, and is also used directly by the legacy
+// GetBasicSession.
+func (s *sshProviderClient) dialClient(ctx context.Context) (*ssh.Client, error) {
+	if len(s.sshConfig.Bastions) > 0 {
+		return s.dialThroughBastions(ctx)
 	}
 
-	// scp over to host
-	err = scp.CopyPath(tempFile.Name(), remotePath, session)
+	address := fmt.Sprintf("%s:%d", s.address, s.port)
+
+	tcpConn, err := dialKeepalive(address)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
-}
+	clientConfig, err := s.clientConfig()
+	if err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
 
-func GetBasicSession(s *sshProviderClient) (*ssh.Session, *ssh.Client, error) {
-	// Create TCP connection so that we can send keep alives.
-	// See https://github.com/golang/go/issues/21478 for why this is not easier...
-	tcpConn, err := func() (c net.Conn, err error) {
-		c, err = net.Dial("tcp", s.address)
-		if err != nil {
-			return nil, err
-		}
+	client, err := newClient(tcpConn, address, clientConfig)
+	if err != nil {
+		return nil, err
+	}
 
-		if err := c.(*net.TCPConn).SetKeepAlive(true); err != nil {
-			return nil, err
-		}
-		if err := c.(*net.TCPConn).SetKeepAlivePeriod(TCPKeepAlivePeriod); err != nil {
-			return nil, err
-		}
+	if s.sshConfig.AgentForwarding {
+		enableAgentForwarding(client)
+	}
 
-		return c, nil
-	}()
+	return client, nil
+}
 
+// enableAgentForwarding connects client's ssh-agent channel to the local
+// agent at SSH_AUTH_SOCK, so that per-session agent.RequestAgentForwarding
+// calls (made in Run) can be served. Forwarding is opt-in via
+// SSHConfig.AgentForwarding and, if no local agent is running, skipped with
+// a logged error rather than failing the dial, consistent with SSHAgent's
+// best-effort auth method.
+func enableAgentForwarding(client *ssh.Client) {
+	sshAgentConn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
 	if err != nil {
-		return nil, nil, err
+		glog.Errorf("agent forwarding requested but no local ssh-agent available: %v", err)
+		return
 	}
 
-	// Construct list of authentication methods
+	agent.ForwardToAgent(client, agent.NewClient(sshAgentConn))
+}
+
+// clientConfig builds the ssh.ClientConfig s authenticates to its own
+// target host with.
+func (s *sshProviderClient) clientConfig() (*ssh.ClientConfig, error) {
 	sshAuthMethods := make([]ssh.AuthMethod, 0)
 
-	if s.privateKey != "" {
+	if s.sshConfig.CertificateSecretName != "" {
+		certSigner, err := loadCertSigner(s.kubeClient, s.namespace, s.sshConfig.CertificateSecretName, s.passPhrase)
+		if err != nil {
+			return nil, err
+		}
+		sshAuthMethods = append(sshAuthMethods, ssh.PublicKeys(certSigner))
+	} else if s.privateKey != "" {
 		publicKeyMethod, err := PublicKeyFile(s.privateKey, s.passPhrase)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 		sshAuthMethods = append(sshAuthMethods, publicKeyMethod)
 	}
@@ -175,21 +263,45 @@ func GetBasicSession(s *sshProviderClient) (*ssh.Session, *ssh.Client, error) {
 		sshAuthMethods = append(sshAuthMethods, sshAgent)
 	}
 
-	// Create SSH client
-	clientConfig := &ssh.ClientConfig{
-		User: s.username,
-		Auth: sshAuthMethods,
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			// TODO: Host key checking is required to guard against
-			// MITM attacks.
-			return nil
-		},
-		Timeout: SshTimeout,
+	hostKeyCallback, err := newHostKeyCallback(s.kubeClient, s.namespace, s.sshConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:              s.username,
+		Auth:              sshAuthMethods,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: preferredHostKeyAlgorithms,
+		Timeout:           SshTimeout,
+	}, nil
+}
+
+// dialKeepalive opens a TCP connection to address with keepalives enabled.
+// See https://github.com/golang/go/issues/21478 for why this is not easier.
+func dialKeepalive(address string) (net.Conn, error) {
+	c, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.(*net.TCPConn).SetKeepAlive(true); err != nil {
+		return nil, err
 	}
+	if err := c.(*net.TCPConn).SetKeepAlivePeriod(TCPKeepAlivePeriod); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
 
-	clientConn, chans, reqs, err := ssh.NewClientConn(tcpConn, s.address, clientConfig)
+// newClient performs the SSH handshake over conn and wraps the result in an
+// *ssh.Client that sends periodic keepalive requests until it errors.
+func newClient(conn net.Conn, address string, clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, address, clientConfig)
 	if err != nil {
-		return nil, nil, err
+		conn.Close()
+		return nil, err
 	}
 
 	client := ssh.NewClient(clientConn, chans, reqs)
@@ -210,7 +322,19 @@ func GetBasicSession(s *sshProviderClient) (*ssh.Session, *ssh.Client, error) {
 		}
 	}()
 
-	// Create SSH session
+	return client, nil
+}
+
+// GetBasicSession dials a dedicated, unpooled connection and session. It
+// predates SSHConnectionPool and is kept only for callers outside this
+// package that still depend on its signature; ProcessCMD,
+// ProcessCMDWithOutput and WriteFile no longer use it.
+func GetBasicSession(s *sshProviderClient) (*ssh.Session, *ssh.Client, error) {
+	client, err := s.dialClient(context.Background())
+	if err != nil {
+		return nil, nil, err
+	}
+
 	session, err := client.NewSession()
 	if err != nil {
 		return nil, client, err